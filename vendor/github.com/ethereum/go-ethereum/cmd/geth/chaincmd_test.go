@@ -0,0 +1,227 @@
+package gethmain
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestBloomFilterAddHas(t *testing.T) {
+	b := newBloomFilter(1000)
+
+	present := make([]common.Hash, 0, 100)
+	for i := uint64(0); i < 100; i++ {
+		var h common.Hash
+		binary.BigEndian.PutUint64(h[:8], i)
+		b.add(h)
+		present = append(present, h)
+	}
+
+	for _, h := range present {
+		if !b.has(h) {
+			t.Fatalf("expected bloom filter to report %x as present", h)
+		}
+	}
+
+	var absent common.Hash
+	binary.BigEndian.PutUint64(absent[:8], ^uint64(0))
+	if b.has(absent) {
+		t.Fatalf("expected bloom filter to report an unadded hash as absent")
+	}
+}
+
+// TestGatherBlockStateConcurrentMatchesSequential builds a small account trie,
+// then walks it both with a single worker (gatherBlockState) and with several
+// workers and a checkpoint file in play (gatherBlockStateConcurrent). The two
+// must agree on node count and value size, and the checkpoint file must be
+// removed after the clean run. The accounts carry only a balance and a nonce,
+// so they have no inner tries and the totals come from the account trie.
+func TestGatherBlockStateConcurrentMatchesSequential(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	statedb, err := state.New(common.Hash{}, state.NewDatabase(db))
+	if err != nil {
+		t.Fatalf("state.New: %v", err)
+	}
+
+	for i := byte(1); i <= 20; i++ {
+		addr := common.BytesToAddress([]byte{i})
+		statedb.AddBalance(addr, big.NewInt(int64(i)))
+		statedb.SetNonce(addr, uint64(i))
+	}
+
+	root, err := statedb.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := statedb.Database().TrieDB().Commit(root, false, nil); err != nil {
+		t.Fatalf("TrieDB Commit: %v", err)
+	}
+
+	header := &types.Header{Number: big.NewInt(0), Root: root}
+	block := types.NewBlock(header, nil, nil, nil)
+	rawdb.WriteBlock(db, block)
+	rawdb.WriteCanonicalHash(db, block.Hash(), 0)
+
+	sequential, err := gatherBlockState(db, 0)
+	if err != nil {
+		t.Fatalf("gatherBlockState: %v", err)
+	}
+
+	resumeFile := filepath.Join(t.TempDir(), "resume")
+	concurrent, err := gatherBlockStateConcurrent(db, 0, 4, resumeFile)
+	if err != nil {
+		t.Fatalf("gatherBlockStateConcurrent: %v", err)
+	}
+
+	if concurrent.Totalnode != sequential.Totalnode {
+		t.Fatalf("node count mismatch: sequential=%d concurrent=%d", sequential.Totalnode, concurrent.Totalnode)
+	}
+	if concurrent.Totalnodevaluesize != sequential.Totalnodevaluesize {
+		t.Fatalf("value size mismatch: sequential=%d concurrent=%d", sequential.Totalnodevaluesize, concurrent.Totalnodevaluesize)
+	}
+
+	if _, err := os.Stat(resumeFile); !os.IsNotExist(err) {
+		t.Fatalf("expected the resume checkpoint to be removed after a clean run, got err=%v", err)
+	}
+}
+
+func TestHashish(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want bool
+	}{
+		{"0", false},
+		{"1234567890", false},
+		{"-1", false},
+		{"0x1234567890abcdef1234567890abcdef1234567890abcdef1234567890abcd", true},
+		{"latest", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		if got := hashish(tt.arg); got != tt.want {
+			t.Errorf("hashish(%q) = %v, want %v", tt.arg, got, tt.want)
+		}
+	}
+}
+
+// TestBuildImportIndexOffsetsLandOnBlockBoundaries writes two RLP-encoded
+// blocks to a file, indexes it, and then re-decodes starting from the first
+// entry's recorded Offset with a brand new rlp.Stream. If countingReader ever
+// regresses to not implementing io.ByteReader, rlp.NewStream silently wraps
+// it in its own read-ahead buffer and the recorded offsets land past the
+// true block boundary, so the re-decode below would fail or return the wrong
+// block.
+func TestBuildImportIndexOffsetsLandOnBlockBoundaries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.rlp")
+	fh, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for _, num := range []int64{0, 1} {
+		block := types.NewBlock(&types.Header{Number: big.NewInt(num)}, nil, nil, nil)
+		if err := rlp.Encode(fh, block); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+	}
+	fh.Close()
+
+	entries, err := buildImportIndex(path)
+	if err != nil {
+		t.Fatalf("buildImportIndex: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Number != 0 || entries[1].Number != 1 {
+		t.Fatalf("unexpected block numbers in index: %+v", entries)
+	}
+
+	fh, err = os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer fh.Close()
+	if _, err := fh.Seek(entries[0].Offset, 0); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	var second types.Block
+	if err := rlp.NewStream(fh, 0).Decode(&second); err != nil {
+		t.Fatalf("decoding from entries[0].Offset failed, index doesn't land on a block boundary: %v", err)
+	}
+	if second.NumberU64() != 1 {
+		t.Fatalf("expected block 1 at entries[0].Offset, got block %d", second.NumberU64())
+	}
+
+	ok, err := verifyImportIndex(path, entries)
+	if err != nil {
+		t.Fatalf("verifyImportIndex: %v", err)
+	}
+	if !ok {
+		t.Fatal("expected a freshly built index to verify against its own file")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("corrupted"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	ok, err = verifyImportIndex(path, entries)
+	if err != nil {
+		t.Fatalf("verifyImportIndex: %v", err)
+	}
+	if ok {
+		t.Fatal("expected verifyImportIndex to reject a modified file")
+	}
+}
+
+// TestLoadGenesisFileStreamsAlloc checks that loadGenesisFile, which decodes
+// the "alloc" section account-by-account via streamGenesisAlloc rather than
+// unmarshalling the whole genesis file at once, still ends up with the same
+// accounts and chain config as a plain json.Unmarshal would produce.
+func TestLoadGenesisFileStreamsAlloc(t *testing.T) {
+	const genesisJSON = `{
+		"config": {"chainId": 1337},
+		"difficulty": "0x1",
+		"gasLimit": "0x47b760",
+		"alloc": {
+			"0x0000000000000000000000000000000000000001": {"balance": "1000"},
+			"0x0000000000000000000000000000000000000002": {"balance": "2000", "code": "0x6001"}
+		}
+	}`
+	path := filepath.Join(t.TempDir(), "genesis.json")
+	if err := ioutil.WriteFile(path, []byte(genesisJSON), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	genesis, err := loadGenesisFile(path)
+	if err != nil {
+		t.Fatalf("loadGenesisFile: %v", err)
+	}
+
+	if genesis.Config == nil || genesis.Config.ChainId == nil || genesis.Config.ChainId.Int64() != 1337 {
+		t.Fatalf("expected chainId 1337, got %+v", genesis.Config)
+	}
+	if len(genesis.Alloc) != 2 {
+		t.Fatalf("expected 2 alloc entries, got %d", len(genesis.Alloc))
+	}
+
+	acc1 := genesis.Alloc[common.HexToAddress("0x1")]
+	if acc1.Balance == nil || acc1.Balance.String() != "1000" {
+		t.Fatalf("unexpected balance for account 1: %+v", acc1.Balance)
+	}
+
+	acc2 := genesis.Alloc[common.HexToAddress("0x2")]
+	if acc2.Balance == nil || acc2.Balance.String() != "2000" {
+		t.Fatalf("unexpected balance for account 2: %+v", acc2.Balance)
+	}
+	if len(acc2.Code) == 0 {
+		t.Fatalf("expected account 2 to carry its code, got %x", acc2.Code)
+	}
+}
@@ -1,6 +1,15 @@
 package common
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/ethereum/go-ethereum/log"
 	"sync/atomic"
 )
@@ -20,6 +29,14 @@ type Service interface {
 	String() string
 }
 
+// HealthChecker is an optional interface a Service can implement to let a
+// ServiceManager monitor it beyond Start/Stop/IsRunning. It is checked on a
+// ticker; a non-nil error flips the service's reported Status to
+// StatusDegraded without otherwise touching IsRunning.
+type HealthChecker interface {
+	HealthCheck() error
+}
+
 /*
 Classical-inheritance-style service declarations. Services can be started, then
 stopped, then optionally restarted.
@@ -188,6 +205,11 @@ func (bs *BaseService) String() string {
 	return bs.name
 }
 
+// HealthCheck is the default, no-op liveness check: always healthy. Services
+// that want a ServiceManager to actually monitor them should override this,
+// the same way OnStart/OnStop are overridden.
+func (bs *BaseService) HealthCheck() error { return nil }
+
 //----------------------------------------
 
 type QuitService struct {
@@ -202,3 +224,301 @@ func NewQuitService(logger log.Logger, name string, impl Service) *QuitService {
 		BaseService: *NewBaseService(logger, name, impl),
 	}
 }
+
+//----------------------------------------
+
+// Status is the aggregate state ServiceManager reports for a managed
+// service, combining its Start/Stop lifecycle with HealthCheck results.
+type Status int
+
+const (
+	StatusUnknown Status = iota
+	StatusRunning
+	StatusDegraded
+	StatusStopped
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusRunning:
+		return "running"
+	case StatusDegraded:
+		return "degraded"
+	case StatusStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// serviceEntry is one node of the dependency DAG a ServiceManager starts and
+// stops as a unit.
+type serviceEntry struct {
+	service   Service
+	dependsOn []string
+}
+
+// ServiceManager starts a DAG of named services in dependency order, stops
+// them in the reverse of that order, and polls each one's HealthCheck (see
+// HealthChecker) on a ticker, aggregating everything into a single Health()
+// snapshot. It is the missing piece for running a set of BaseServices (e.g.
+// a pchain validator's consensus, RPC and p2p services) under systemd/k8s
+// with a proper liveness/readiness probe.
+type ServiceManager struct {
+	mtx      sync.Mutex
+	entries  map[string]*serviceEntry
+	order    []string
+	status   map[string]Status
+	interval time.Duration
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewServiceManager creates a ServiceManager that polls HealthCheck on each
+// managed service every healthCheckInterval once Start has been called. A
+// non-positive interval disables health polling; services are still
+// started/stopped in dependency order.
+func NewServiceManager(healthCheckInterval time.Duration) *ServiceManager {
+	return &ServiceManager{
+		entries:  make(map[string]*serviceEntry),
+		status:   make(map[string]Status),
+		interval: healthCheckInterval,
+		quit:     make(chan struct{}),
+	}
+}
+
+// AddService registers svc under name, depending on the named services in
+// dependsOn. Every dependency must itself be registered before Start is
+// called. AddService must not be called after Start.
+func (m *ServiceManager) AddService(name string, svc Service, dependsOn ...string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.entries[name] = &serviceEntry{service: svc, dependsOn: dependsOn}
+	m.status[name] = StatusUnknown
+}
+
+// Start resolves the dependency DAG into a topological order and starts
+// every service in that order, stopping at (and returning) the first error.
+// It then begins polling health checks in the background. Start fails
+// without starting anything if the DAG references an unknown dependency or
+// contains a cycle.
+func (m *ServiceManager) Start() error {
+	m.mtx.Lock()
+	order, err := m.topoSort()
+	if err != nil {
+		m.mtx.Unlock()
+		return err
+	}
+	m.order = order
+	entries := m.entries
+	m.mtx.Unlock()
+
+	for _, name := range order {
+		if _, err := entries[name].service.Start(); err != nil {
+			return fmt.Errorf("starting service %q: %v", name, err)
+		}
+		m.setStatus(name, StatusRunning)
+	}
+	go m.healthLoop()
+	return nil
+}
+
+// Stop stops every managed service in the reverse of the order Start used
+// and halts health polling. Like BaseService.Stop, it is ok to call Stop
+// more than once, or without a prior Start; only the first call has any
+// effect.
+func (m *ServiceManager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.quit)
+
+		m.mtx.Lock()
+		order, entries := m.order, m.entries
+		m.mtx.Unlock()
+
+		for i := len(order) - 1; i >= 0; i-- {
+			name := order[i]
+			entries[name].service.Stop()
+			m.setStatus(name, StatusStopped)
+		}
+	})
+}
+
+// Health returns a snapshot of every managed service's current status.
+func (m *ServiceManager) Health() map[string]Status {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	out := make(map[string]Status, len(m.status))
+	for name, status := range m.status {
+		out[name] = status
+	}
+	return out
+}
+
+func (m *ServiceManager) setStatus(name string, status Status) {
+	m.mtx.Lock()
+	m.status[name] = status
+	m.mtx.Unlock()
+}
+
+// healthLoop polls every managed, running service's HealthCheck (when it
+// implements HealthChecker) on a ticker, flipping its status to
+// StatusDegraded on failure and logging a structured event, and back to
+// StatusRunning once it recovers.
+func (m *ServiceManager) healthLoop() {
+	if m.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-ticker.C:
+			m.mtx.Lock()
+			entries := m.entries
+			m.mtx.Unlock()
+
+			for name, entry := range entries {
+				if !entry.service.IsRunning() {
+					continue
+				}
+				checker, ok := entry.service.(HealthChecker)
+				if !ok {
+					continue
+				}
+				status := StatusRunning
+				if err := checker.HealthCheck(); err != nil {
+					log.Error("Service health check failed", "service", name, "err", err)
+					status = StatusDegraded
+				}
+				// Stop may have run since the IsRunning check above; never
+				// overwrite the StatusStopped it recorded.
+				m.mtx.Lock()
+				if m.status[name] != StatusStopped {
+					m.status[name] = status
+				}
+				m.mtx.Unlock()
+			}
+		}
+	}
+}
+
+// topoSort computes a dependency-respecting start order for m.entries,
+// failing if an entry depends on an unregistered service or the graph has a
+// cycle. Callers must hold m.mtx.
+func (m *ServiceManager) topoSort() ([]string, error) {
+	const (
+		white = iota
+		gray
+		black
+	)
+	color := make(map[string]int, len(m.entries))
+	var order []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch color[name] {
+		case black:
+			return nil
+		case gray:
+			return fmt.Errorf("dependency cycle detected at service %q", name)
+		}
+		entry, ok := m.entries[name]
+		if !ok {
+			return fmt.Errorf("unknown service %q referenced as a dependency", name)
+		}
+		color[name] = gray
+		for _, dep := range entry.dependsOn {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		color[name] = black
+		order = append(order, name)
+		return nil
+	}
+
+	// Visit in a stable order so Start/Stop ordering doesn't depend on map
+	// iteration order when the DAG doesn't otherwise constrain it.
+	names := make([]string, 0, len(m.entries))
+	for name := range m.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// HealthzHandler reports every managed service's status as a JSON object,
+// returning 503 if any service isn't StatusRunning. Register it on the
+// node's existing RPC/HTTP mux as /healthz for use as a liveness probe.
+func (m *ServiceManager) HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := m.Health()
+
+		body := make(map[string]string, len(health))
+		healthy := true
+		for name, status := range health {
+			body[name] = status.String()
+			if status != StatusRunning {
+				healthy = false
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+// ReadyzHandler reports 200 once every managed service has started at least
+// once (i.e. none are StatusUnknown) and the manager hasn't been stopped,
+// regardless of subsequent degraded health checks, and 503 otherwise.
+// Register it as /readyz for use as a readiness probe.
+func (m *ServiceManager) ReadyzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, status := range m.Health() {
+			if status == StatusUnknown || status == StatusStopped {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// RegisterHandlers mounts HealthzHandler and ReadyzHandler on mux at
+// /healthz and /readyz. Call this with the node's existing RPC/HTTP mux
+// (e.g. *http.ServeMux) once the ServiceManager has had its services added,
+// typically right before Start.
+func (m *ServiceManager) RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/healthz", m.HealthzHandler())
+	mux.Handle("/readyz", m.ReadyzHandler())
+}
+
+// ListenAndServeHealthz starts a dedicated HTTP server on addr exposing
+// /healthz and /readyz, for nodes that don't otherwise share an HTTP mux
+// with the ServiceManager. It returns immediately; the returned Closer
+// shuts the listener down. Call it once, after AddService and before or
+// right after Start.
+func (m *ServiceManager) ListenAndServeHealthz(addr string) (io.Closer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	m.RegisterHandlers(mux)
+
+	srv := &http.Server{Addr: ln.Addr().String(), Handler: mux}
+	go srv.Serve(ln)
+	return srv, nil
+}
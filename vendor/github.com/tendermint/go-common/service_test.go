@@ -0,0 +1,102 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testService struct {
+	BaseService
+}
+
+func newTestService() *testService {
+	ts := &testService{}
+	ts.BaseService = *NewBaseService(nil, "testService", ts)
+	return ts
+}
+
+func TestServiceManagerStopIsIdempotent(t *testing.T) {
+	m := NewServiceManager(0)
+	m.AddService("a", newTestService())
+
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	m.Stop()
+	m.Stop() // must not panic with "close of closed channel"
+}
+
+func TestServiceManagerStopWithoutStart(t *testing.T) {
+	m := NewServiceManager(0)
+	m.AddService("a", newTestService())
+
+	m.Stop()
+	m.Stop()
+}
+
+func TestServiceManagerTopoSortCycle(t *testing.T) {
+	m := NewServiceManager(0)
+	m.AddService("a", newTestService(), "b")
+	m.AddService("b", newTestService(), "a")
+
+	if err := m.Start(); err == nil {
+		t.Fatal("expected Start to fail on a dependency cycle")
+	}
+}
+
+func TestServiceManagerTopoSortUnknownDependency(t *testing.T) {
+	m := NewServiceManager(0)
+	m.AddService("a", newTestService(), "missing")
+
+	if err := m.Start(); err == nil {
+		t.Fatal("expected Start to fail on an unknown dependency")
+	}
+}
+
+func TestReadyzHandlerReflectsStop(t *testing.T) {
+	m := NewServiceManager(time.Millisecond)
+	m.AddService("a", newTestService())
+
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	m.ReadyzHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 200 {
+		t.Fatalf("expected 200 while running, got %d", rec.Code)
+	}
+
+	m.Stop()
+
+	rec = httptest.NewRecorder()
+	m.ReadyzHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 503 {
+		t.Fatalf("expected 503 after Stop, got %d", rec.Code)
+	}
+}
+
+func TestListenAndServeHealthz(t *testing.T) {
+	m := NewServiceManager(0)
+	m.AddService("a", newTestService())
+
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer m.Stop()
+
+	closer, err := m.ListenAndServeHealthz("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenAndServeHealthz: %v", err)
+	}
+	defer closer.Close()
+
+	srv := closer.(*http.Server)
+	addr := srv.Addr
+	if addr == "" {
+		t.Fatal("expected the server to have bound a listener")
+	}
+}